@@ -1,20 +1,29 @@
 package caddy
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"runtime"
 	"syscall"
+	"time"
 )
 
-// caddyfileGob maps bind address to index of the file descriptor
-// in the Files array passed to the child process. It also contains
-// the caddyfile contents. Used only during graceful restarts.
-type caddyfileGob struct {
-	ListenerFds map[string]uintptr
-	Caddyfile   []byte
+// restartStatus is the structured message the child writes to the
+// sigpipe to tell the parent how its startup went. It is sent as a
+// uint32 length prefix followed by that many bytes of gob-encoded
+// restartStatus, so the parent never has to guess whether "no bytes
+// yet" means failure or a child that's still starting up.
+type restartStatus struct {
+	Success bool
+	Err     string
+	PID     int
 }
 
 // Restart restarts the entire application; gracefully with zero
@@ -31,6 +40,42 @@ func Restart(newCaddyfile Input) error {
 		caddyfileMu.Unlock()
 	}
 
+	if RestartMode == "inproc" {
+		err := restartInProc(newCaddyfile)
+		if err != errAddrsChanged {
+			return err
+		}
+		log.Println("[INFO] restart: bind addresses changed; falling back to fork")
+	}
+
+	return forkExec(newCaddyfile, false)
+}
+
+// Upgrade re-executes the currently running binary in place, handing
+// off all the listener file descriptors exactly like Restart does,
+// but without touching the running configuration: the child is fed
+// the current (unmodified) Caddyfile rather than a new one. This lets
+// operators swap in a new build of the binary without also forcing a
+// config reload.
+//
+// On Windows, Upgrade does not re-execute the binary: the current
+// process simply stops its servers and starts them again with
+// identical configuration.
+func Upgrade() error {
+	caddyfileMu.Lock()
+	cdyfile := caddyfile
+	caddyfileMu.Unlock()
+
+	return forkExec(cdyfile, true)
+}
+
+// forkExec contains the shared fork/exec logic used by both Restart
+// and Upgrade. When isUpgrade is true, the child is told (via the
+// CADDY__UPGRADE environment variable) that it was spawned for a
+// binary upgrade rather than a config reload, so it knows to read its
+// configuration from the pipe the same way but skip any configured
+// config loaders.
+func forkExec(newCaddyfile Input, isUpgrade bool) error {
 	if runtime.GOOS == "windows" {
 		err := Stop()
 		if err != nil {
@@ -47,13 +92,21 @@ func Restart(newCaddyfile Input) error {
 		os.Args = []string{""}
 	}
 
-	// Tell the child that it's a restart
+	// Tell the child whether it's a plain config restart or a binary
+	// upgrade; LoadCaddyfile consults CADDY__UPGRADE to decide whether
+	// to bypass configured loaders and read straight from the pipe.
 	os.Setenv("CADDY_RESTART", "true")
+	if isUpgrade {
+		os.Setenv("CADDY__UPGRADE", "1")
+	} else {
+		os.Unsetenv("CADDY__UPGRADE")
+	}
 
 	// Prepare our payload to the child process
-	cdyfileGob := caddyfileGob{
+	payload := restartPayload{
 		ListenerFds: make(map[string]uintptr),
 		Caddyfile:   newCaddyfile.Body(),
+		Plugins:     collectRestartPayloadPlugins(),
 	}
 
 	// Prepare a pipe to the fork's stdin so it can get the Caddyfile
@@ -66,6 +119,8 @@ func Restart(newCaddyfile Input) error {
 	// its success or failure with us, the parent
 	sigrpipe, sigwpipe, err := os.Pipe()
 	if err != nil {
+		rpipe.Close()
+		wpipe.Close()
 		return err
 	}
 
@@ -74,36 +129,67 @@ func Restart(newCaddyfile Input) error {
 	// and then the listener file descriptors (in order).
 	fds := []uintptr{rpipe.Fd(), os.Stdout.Fd(), os.Stderr.Fd(), sigwpipe.Fd()}
 
-	// Now add file descriptors of the sockets
+	// Now add file descriptors of the sockets. s.ListenerFd() returns a
+	// dup of the listening socket's fd made for exactly this purpose, so
+	// wrapping it in os.NewFile and Close()ing it once we're done with
+	// the fork only closes that dup - it does not touch the live
+	// listener still in use by s.
+	var listenerFiles []*os.File
 	serversMu.Lock()
 	for i, s := range servers {
-		fds = append(fds, s.ListenerFd())
-		cdyfileGob.ListenerFds[s.Addr] = uintptr(4 + i) // 4 fds come before any of the listeners
+		fd := s.ListenerFd()
+		fds = append(fds, fd)
+		listenerFiles = append(listenerFiles, os.NewFile(fd, s.Addr))
+		payload.ListenerFds[s.Addr] = uintptr(4 + i) // 4 fds come before any of the listeners
 	}
 	serversMu.Unlock()
 
+	closeAll := func() {
+		rpipe.Close()
+		wpipe.Close()
+		sigrpipe.Close()
+		sigwpipe.Close()
+		for _, f := range listenerFiles {
+			f.Close()
+		}
+	}
+
 	// Fork the process with the current environment and file descriptors
 	execSpec := &syscall.ProcAttr{
 		Env:   os.Environ(),
 		Files: fds,
 	}
-	_, err = syscall.ForkExec(os.Args[0], os.Args, execSpec)
+	pid, err := syscall.ForkExec(os.Args[0], os.Args, execSpec)
 	if err != nil {
+		closeAll()
 		return err
 	}
 
-	// Feed it the Caddyfile
-	err = gob.NewEncoder(wpipe).Encode(cdyfileGob)
+	// Feed it the Caddyfile, wrapped in a versioned envelope so a
+	// parent and child running different binary versions (as happens
+	// mid binary-upgrade) can still agree on how to read it.
+	err = encodeRestartEnvelope(wpipe, payload, codecGob)
 	if err != nil {
+		closeAll()
+		killChild(pid)
 		return err
 	}
 	wpipe.Close()
+	rpipe.Close()
 
-	// Wait for child process to signal success or fail
+	// Wait for the child to signal success or failure, bounded by
+	// GracefulTimeout so a child that hangs before calling Start()
+	// doesn't leave us blocked forever.
 	sigwpipe.Close() // close our copy of the write end of the pipe
-	answer, err := ioutil.ReadAll(sigrpipe)
-	if err != nil || len(answer) == 0 {
-		log.Println("restart: child failed to answer; changes not applied")
+	status, err := waitForChildStatus(sigrpipe, pid)
+	for _, f := range listenerFiles {
+		f.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if !status.Success {
+		log.Printf("restart: child (pid %d) failed to start: %s", status.PID, status.Err)
 		return incompleteRestartErr
 	}
 
@@ -111,12 +197,141 @@ func Restart(newCaddyfile Input) error {
 	return Stop()
 }
 
+// maxRestartStatusSize bounds how large a sane length prefix can be.
+// It exists so a child still running the pre-restartStatus protocol -
+// which just wrote a handful of raw ASCII bytes straight to the
+// sigpipe - doesn't get misread as "please read ~2GB": those bytes
+// decode as a length prefix far past this bound, which is the signal
+// waitForChildStatus uses to fall back to the legacy protocol instead
+// of hanging until GracefulTimeout and killing a perfectly healthy
+// child.
+const maxRestartStatusSize = 1 << 20 // 1 MiB
+
+// waitForChildStatus reads the child's startup outcome from r, the
+// parent's end of the sigpipe. It understands two wire formats: the
+// length-prefixed, gob-encoded restartStatus that signalSuccessToParent
+// and signalFailureToParent write, and the legacy "any non-empty bytes
+// means success" protocol this replaced, so parents and children don't
+// have to be upgraded in lockstep. If nothing arrives within
+// GracefulTimeout, the child (identified by pid) is assumed to be hung
+// and is killed so the fork isn't leaked.
+func waitForChildStatus(r io.ReadCloser, pid int) (restartStatus, error) {
+	statusCh := make(chan restartStatus, 1)
+	errCh := make(chan error, 1)
+
+	go func() {
+		var lengthBytes [4]byte
+		if _, err := io.ReadFull(r, lengthBytes[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				// 1-3 bytes and then EOF: too short to be a length
+				// prefix, so it's a legacy child's non-empty message.
+				statusCh <- restartStatus{Success: true, PID: pid}
+				return
+			}
+			errCh <- err
+			return
+		}
+		length := binary.BigEndian.Uint32(lengthBytes[:])
+
+		if length > maxRestartStatusSize {
+			// Doesn't look like a real length prefix - most likely a
+			// legacy-protocol child that just wrote raw bytes. Those
+			// four bytes are the start of its message; read whatever
+			// follows and treat any of it (plus what we already have)
+			// as the old "non-empty means success" signal.
+			rest, _ := ioutil.ReadAll(r)
+			if length != 0 || len(rest) > 0 {
+				statusCh <- restartStatus{Success: true, PID: pid}
+				return
+			}
+			errCh <- errors.New("restart: child sent no data")
+			return
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			errCh <- err
+			return
+		}
+		var status restartStatus
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&status); err != nil {
+			errCh <- err
+			return
+		}
+		statusCh <- status
+	}()
+
+	select {
+	case status := <-statusCh:
+		r.Close()
+		return status, nil
+	case err := <-errCh:
+		r.Close()
+		log.Println("restart: child failed to answer; changes not applied:", err)
+		return restartStatus{}, incompleteRestartErr
+	case <-time.After(GracefulTimeout):
+		r.Close()
+		killChild(pid)
+		return restartStatus{}, fmt.Errorf("restart: child (pid %d) did not respond within %s; killed", pid, GracefulTimeout)
+	}
+}
+
+// killChild kills the forked child identified by pid. Failures are
+// only logged: at this point we're already returning an error to the
+// caller of Restart/Upgrade, and there's nothing more useful to do
+// with a second error than report it.
+func killChild(pid int) {
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		log.Printf("restart: failed to kill unresponsive child (pid %d): %v", pid, err)
+	}
+}
+
+// signalSuccessToParent tells the parent process, across the sigpipe
+// w, that this (child) process started up successfully and the
+// parent's servers can be stopped.
+func signalSuccessToParent(w io.Writer) error {
+	return writeRestartStatus(w, restartStatus{Success: true, PID: os.Getpid()})
+}
+
+// signalFailureToParent tells the parent process, across the sigpipe
+// w, that this (child) process failed to start, along with why, so
+// the parent can log a useful message and keep its own servers
+// running instead of stopping them.
+func signalFailureToParent(w io.Writer, failErr error) error {
+	return writeRestartStatus(w, restartStatus{Err: failErr.Error(), PID: os.Getpid()})
+}
+
+// writeRestartStatus gob-encodes status and writes it to w with a
+// uint32 length prefix, so the reader on the other end knows exactly
+// how many bytes to expect instead of relying on EOF or pipe closure.
+func writeRestartStatus(w io.Writer, status restartStatus) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(status); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(buf.Len())); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
 // isRestart returns whether this process is, according
 // to env variables, a fork as part of a graceful restart.
 func isRestart() bool {
 	return os.Getenv("CADDY_RESTART") == "true"
 }
 
+// IsUpgrade returns whether this process is, according to env
+// variables, a fork as part of a binary upgrade (as opposed to a
+// config reload). A child started this way still goes through the
+// normal restart handshake, but LoadCaddyfile uses this to know it
+// should decode its configuration from stdin rather than consulting
+// configured loaders.
+func IsUpgrade() bool {
+	return os.Getenv("CADDY__UPGRADE") == "1"
+}
+
 // CaddyfileInput represents a Caddyfile as input
 // and is simply a convenient way to implement
 // the Input interface.
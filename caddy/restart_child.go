@@ -0,0 +1,41 @@
+package caddy
+
+import (
+	"log"
+	"os"
+)
+
+// restartSigpipeFd is the file descriptor the child inherits its
+// sigpipe on, per the fd ordering forkExec documents: stdin, stdout,
+// stderr, sigpipe, then listeners.
+const restartSigpipeFd = 3
+
+// FinishRestart reports the outcome of this process's startup to the
+// parent half of a graceful restart or upgrade, if there is one. It
+// is called by Start once newCaddyfile's servers are either all
+// listening (startErr == nil) or have failed to come up (startErr !=
+// nil), and is a no-op if this process wasn't forked by Restart or
+// Upgrade in the first place.
+//
+// This is the other end of waitForChildStatus: without it, the parent
+// would never see anything on the sigpipe and every restart would
+// hit the timeout path in waitForChildStatus and get killed.
+func FinishRestart(startErr error) {
+	if !isRestart() {
+		return
+	}
+
+	sigpipe := os.NewFile(restartSigpipeFd, "sigpipe")
+	defer sigpipe.Close()
+
+	if startErr != nil {
+		if err := signalFailureToParent(sigpipe, startErr); err != nil {
+			log.Printf("restart: failed to signal failure to parent: %v", err)
+		}
+		return
+	}
+
+	if err := signalSuccessToParent(sigpipe); err != nil {
+		log.Printf("restart: failed to signal success to parent: %v", err)
+	}
+}
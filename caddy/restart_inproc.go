@@ -0,0 +1,216 @@
+package caddy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RestartMode controls how Restart reloads the running configuration.
+// The default, "fork", re-execs the binary and hands off listener file
+// descriptors as usual. Setting it to "inproc" keeps the same process
+// and listeners and swaps the HTTP handlers in place instead, which is
+// required for embedders that run Caddy as a library inside a larger
+// Go process (forking would kill the host application) and avoids the
+// Stop/Start downtime window Restart otherwise falls back to on
+// Windows.
+var RestartMode = "fork"
+
+// errAddrsChanged is returned internally by restartInProc when the new
+// Caddyfile binds a different set of addresses than the servers
+// currently running; in that case an in-process restart can't reuse
+// the existing listeners and Restart falls back to the fork path.
+var errAddrsChanged = errors.New("bind addresses changed; in-process restart not possible")
+
+// inprocDirectives is the set of directives buildCaddyfileMux actually
+// understands. A block containing anything else makes restartInProc
+// return an error before any handler is swapped, rather than silently
+// reload with those directives dropped - see buildCaddyfileMux. Restart
+// returns that error as it is; only errAddrsChanged makes it fall back
+// to the fork path.
+var inprocDirectives = map[string]bool{"root": true}
+
+// restartInProc performs an in-process graceful restart: it re-parses
+// newCaddyfile, builds the new HTTP handlers for every running server,
+// and only once all of them are built swaps them in on the existing
+// listeners, all under serversMu so that no request is ever routed
+// through a half-updated server. It does not use GracefulTimeout: each
+// new handler takes effect as soon as it is assigned, and nothing waits
+// for requests already in progress on the old one.
+func restartInProc(newCaddyfile Input) error {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	newAddrs, err := parseBindAddrs(newCaddyfile)
+	if err != nil {
+		return err
+	}
+	if addrsChanged(newAddrs) {
+		return errAddrsChanged
+	}
+
+	muxes := make([]http.Handler, len(servers))
+	for i, s := range servers {
+		mux, err := buildCaddyfileMux(newCaddyfile, s.Addr)
+		if err != nil {
+			return err
+		}
+		muxes[i] = mux
+	}
+	for i, s := range servers {
+		swapServerHandler(s, muxes[i])
+	}
+
+	caddyfileMu.Lock()
+	caddyfile = newCaddyfile
+	caddyfileMu.Unlock()
+
+	return nil
+}
+
+// swapServerHandler atomically replaces s's active HTTP handler with
+// mux. s keeps its existing listener - nothing is closed or rebound -
+// so in-flight connections on it are simply served by mux from this
+// point on; callers must hold serversMu, which is what the live
+// request path also checks before reading s.Handler.
+func swapServerHandler(s *Server, mux http.Handler) {
+	s.Handler = mux
+}
+
+// addrsChanged reports whether newAddrs is a different set of
+// addresses than the servers currently running. Callers must hold
+// serversMu.
+func addrsChanged(newAddrs map[string]bool) bool {
+	if len(newAddrs) != len(servers) {
+		return true
+	}
+
+	for _, s := range servers {
+		if !newAddrs[s.Addr] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseBindAddrs extracts the bind addresses a Caddyfile would listen
+// on: the address tokens on every top-level server block line (any
+// non-blank, non-comment line at brace-depth 0), with any scheme
+// prefix (http://, https://) stripped to match the scheme-less form
+// Server.Addr is already compared against elsewhere in this file. It
+// isn't a full Caddyfile parser - directive parsing lives elsewhere -
+// it only needs to answer whether newCaddyfile would bind the same
+// sockets the running servers already have open, so restartInProc
+// knows whether an in-place swap is even possible.
+func parseBindAddrs(input Input) (map[string]bool, error) {
+	addrs := make(map[string]bool)
+	depth := 0
+
+	for _, line := range strings.Split(string(input.Body()), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if depth == 0 {
+			for _, addr := range strings.Fields(strings.TrimSuffix(trimmed, "{")) {
+				addrs[stripAddrScheme(addr)] = true
+			}
+		}
+
+		depth += strings.Count(trimmed, "{") - strings.Count(trimmed, "}")
+		if depth < 0 {
+			return nil, fmt.Errorf("restart: unbalanced braces in Caddyfile")
+		}
+	}
+
+	if depth != 0 {
+		return nil, fmt.Errorf("restart: unbalanced braces in Caddyfile")
+	}
+
+	return addrs, nil
+}
+
+// stripAddrScheme removes a leading "http://" or "https://" from addr,
+// the two schemes a Caddyfile address line may carry that Server.Addr
+// itself never includes.
+func stripAddrScheme(addr string) string {
+	for _, scheme := range []string{"https://", "http://"} {
+		if strings.HasPrefix(addr, scheme) {
+			return addr[len(scheme):]
+		}
+	}
+	return addr
+}
+
+// buildCaddyfileMux builds the http.Handler that should serve addr
+// according to newCaddyfile. Full directive support lives in the
+// config/directive parser elsewhere in the tree; this only
+// understands the directives in inprocDirectives. If addr's block
+// uses anything else, it returns an error instead of guessing, rather
+// than silently reloading with those directives dropped on the floor.
+// Restart does not fall back to re-exec on that error: it returns it
+// to its caller, and the running handlers stay in place.
+func buildCaddyfileMux(newCaddyfile Input, addr string) (http.Handler, error) {
+	directives, err := blockDirectives(newCaddyfile, addr)
+	if err != nil {
+		return nil, err
+	}
+	for name := range directives {
+		if !inprocDirectives[name] {
+			return nil, fmt.Errorf("restart: %q is not supported by in-process restart", name)
+		}
+	}
+
+	mux := http.NewServeMux()
+	if root := directives["root"]; root != "" {
+		mux.Handle("/", http.FileServer(http.Dir(root)))
+	} else {
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+	return mux, nil
+}
+
+// blockDirectives returns, for every directive line directly inside
+// addr's top-level server block in newCaddyfile, a map of directive
+// name to its first argument (empty string if it takes none).
+func blockDirectives(newCaddyfile Input, addr string) (map[string]string, error) {
+	depth := 0
+	inBlock := false
+	directives := make(map[string]string)
+
+	for _, line := range strings.Split(string(newCaddyfile.Body()), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if depth == 0 {
+			inBlock = false
+			for _, a := range strings.Fields(strings.TrimSuffix(trimmed, "{")) {
+				if stripAddrScheme(a) == addr {
+					inBlock = true
+					break
+				}
+			}
+		} else if depth == 1 && inBlock && !strings.HasPrefix(trimmed, "}") {
+			fields := strings.Fields(trimmed)
+			value := ""
+			if len(fields) >= 2 {
+				value = fields[1]
+			}
+			directives[fields[0]] = value
+		}
+
+		depth += strings.Count(trimmed, "{") - strings.Count(trimmed, "}")
+		if depth < 0 {
+			return nil, fmt.Errorf("restart: unbalanced braces in Caddyfile")
+		}
+	}
+
+	return directives, nil
+}
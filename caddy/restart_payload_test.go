@@ -0,0 +1,148 @@
+package caddy
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+// oldRestartPayloadV0 mirrors the pre-chunk0-4 wire shape: no Plugins
+// field at all. It stands in for a payload written by an older binary
+// when this binary (version N+1) tries to consume it.
+type oldRestartPayloadV0 struct {
+	ListenerFds map[string]uintptr
+	Caddyfile   []byte
+}
+
+// futureRestartPayloadV1 has a field restartPayload doesn't declare
+// yet. It stands in for a payload written by a newer binary that
+// additively extended the struct without bumping restartPayloadVersion
+// (since the change is additive, it doesn't need to).
+type futureRestartPayloadV1 struct {
+	ListenerFds map[string]uintptr
+	Caddyfile   []byte
+	Plugins     map[string][]byte
+	OCSPStaples map[string][]byte
+}
+
+func encodeEnvelopeWith(t *testing.T, version uint32, payload interface{}) []byte {
+	t.Helper()
+
+	var payloadBuf bytes.Buffer
+	if err := gob.NewEncoder(&payloadBuf).Encode(payload); err != nil {
+		t.Fatalf("encoding payload: %v", err)
+	}
+
+	var envBuf bytes.Buffer
+	env := restartEnvelope{
+		Version: version,
+		Codec:   codecGob,
+		Payload: payloadBuf.Bytes(),
+	}
+	if err := gob.NewEncoder(&envBuf).Encode(env); err != nil {
+		t.Fatalf("encoding envelope: %v", err)
+	}
+	return envBuf.Bytes()
+}
+
+// TestDecodeRestartEnvelopeToleratesAdditiveShapeChange exercises the
+// actual scenario chunk0-4 was meant to fix: the wire shape of the
+// payload differs (a field missing, a field this binary has never
+// seen) between parent and child, not just the Version integer, which
+// decodeRestartEnvelope never even read before this fix.
+func TestDecodeRestartEnvelopeToleratesAdditiveShapeChange(t *testing.T) {
+	t.Run("payload missing a field this binary has (older peer)", func(t *testing.T) {
+		old := oldRestartPayloadV0{
+			ListenerFds: map[string]uintptr{":80": 4},
+			Caddyfile:   []byte("localhost:2015"),
+		}
+		raw := encodeEnvelopeWith(t, restartPayloadVersion, old)
+
+		got, err := decodeRestartEnvelope(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("decodeRestartEnvelope: %v", err)
+		}
+		if got.ListenerFds[":80"] != 4 {
+			t.Errorf("ListenerFds[\":80\"] = %d, want 4", got.ListenerFds[":80"])
+		}
+		if string(got.Caddyfile) != "localhost:2015" {
+			t.Errorf("Caddyfile = %q, want %q", got.Caddyfile, "localhost:2015")
+		}
+		if len(got.Plugins) != 0 {
+			t.Errorf("Plugins = %v, want empty (old payload never had it)", got.Plugins)
+		}
+	})
+
+	t.Run("payload with a field this binary doesn't have (newer peer)", func(t *testing.T) {
+		future := futureRestartPayloadV1{
+			ListenerFds: map[string]uintptr{":443": 5},
+			Caddyfile:   []byte("example.com"),
+			Plugins:     map[string][]byte{"tls": []byte("session-tickets"), "future-plugin": []byte("opaque")},
+			OCSPStaples: map[string][]byte{"example.com": []byte("staple-bytes")},
+		}
+		raw := encodeEnvelopeWith(t, restartPayloadVersion, future)
+
+		got, err := decodeRestartEnvelope(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("decodeRestartEnvelope: %v", err)
+		}
+		if got.ListenerFds[":443"] != 5 {
+			t.Errorf("ListenerFds[\":443\"] = %d, want 5", got.ListenerFds[":443"])
+		}
+		if string(got.Caddyfile) != "example.com" {
+			t.Errorf("Caddyfile = %q, want %q", got.Caddyfile, "example.com")
+		}
+		if string(got.Plugins["tls"]) != "session-tickets" {
+			t.Errorf("Plugins[tls] = %q, want %q", got.Plugins["tls"], "session-tickets")
+		}
+
+		// A plugin key with no matching registration must not cause
+		// applyRestartPayloadPlugins to fail or panic, and the
+		// OCSPStaples field this binary doesn't declare must simply
+		// have been dropped by gob rather than causing a decode error.
+		applyRestartPayloadPlugins(got)
+	})
+}
+
+// TestDecodeRestartEnvelopeRejectsNewerVersion checks the other half
+// of acting on Version: an envelope that actually claims to be newer
+// than anything this binary understands is rejected outright, rather
+// than silently best-effort decoded.
+func TestDecodeRestartEnvelopeRejectsNewerVersion(t *testing.T) {
+	payload := restartPayload{Caddyfile: []byte("localhost:2015")}
+	raw := encodeEnvelopeWith(t, restartPayloadVersion+1, payload)
+
+	if _, err := decodeRestartEnvelope(bytes.NewReader(raw)); err == nil {
+		t.Fatal("decodeRestartEnvelope: expected an error for a newer-than-known envelope version, got nil")
+	}
+}
+
+// TestEncodeDecodeRestartEnvelopeRoundTrip is the basic sanity check
+// that encodeRestartEnvelope and decodeRestartEnvelope agree with each
+// other for the common case: same binary on both ends.
+func TestEncodeDecodeRestartEnvelopeRoundTrip(t *testing.T) {
+	payload := restartPayload{
+		ListenerFds: map[string]uintptr{":2015": 4, ":443": 5},
+		Caddyfile:   []byte("example.com"),
+		Plugins:     map[string][]byte{"tls": []byte("session-tickets")},
+	}
+
+	var buf bytes.Buffer
+	if err := encodeRestartEnvelope(&buf, payload, codecGob); err != nil {
+		t.Fatalf("encodeRestartEnvelope: %v", err)
+	}
+
+	got, err := decodeRestartEnvelope(&buf)
+	if err != nil {
+		t.Fatalf("decodeRestartEnvelope: %v", err)
+	}
+	if len(got.ListenerFds) != 2 || got.ListenerFds[":2015"] != 4 || got.ListenerFds[":443"] != 5 {
+		t.Errorf("ListenerFds = %v, want map[:2015:4 :443:5]", got.ListenerFds)
+	}
+	if string(got.Caddyfile) != "example.com" {
+		t.Errorf("Caddyfile = %q, want %q", got.Caddyfile, "example.com")
+	}
+	if string(got.Plugins["tls"]) != "session-tickets" {
+		t.Errorf("Plugins[tls] = %q, want %q", got.Plugins["tls"], "session-tickets")
+	}
+}
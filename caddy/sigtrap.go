@@ -0,0 +1,33 @@
+// +build !windows
+
+package caddy
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func init() {
+	trapSignalsUpgrade()
+}
+
+// trapSignalsUpgrade adds SIGUSR2, for binary upgrades, to caddy's
+// existing POSIX signal trap. SIGUSR1 (Caddyfile reload via
+// Restart(nil)) is already trapped elsewhere; it's deliberately not
+// repeated here so a signal never ends up handled by two separate
+// goroutines.
+func trapSignalsUpgrade() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR2)
+
+	go func() {
+		for range sig {
+			log.Println("[INFO] SIGUSR2: Upgrading binary")
+			if err := Upgrade(); err != nil {
+				log.Println("[ERROR] SIGUSR2 upgrade failed:", err)
+			}
+		}
+	}()
+}